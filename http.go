@@ -19,13 +19,22 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
+	"expvar"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"math/rand"
 	"net/http"
 	"net/http/httputil"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
+
+	"golang.org/x/time/rate"
 )
 
 type addKeyTransport struct {
@@ -74,40 +83,932 @@ func (lt LoggingTransport) RoundTrip(req *http.Request) (*http.Response, error)
 	return resp, err
 }
 
+// StreamingLoggingTransport is like LoggingTransport, but never buffers a
+// whole request or response body in memory. It logs the request line and
+// headers up front, then wraps the request and response bodies so that
+// bytes are copied out to the sink as the underlying transport (and
+// whatever is consuming the response) actually reads them. This keeps
+// --dump-http usable for multi-gigabyte Drive uploads and downloads.
+type StreamingLoggingTransport struct {
+	transport http.RoundTripper
+	sink      *syncWriter
+	maxLogged int64 // max bytes of each body to copy to sink; <0 means unlimited
+}
+
+// NewStreamingLoggingTransport returns a StreamingLoggingTransport that logs
+// to sink, copying at most maxLogged bytes of each request/response body
+// (pass a negative value for no limit); bytes beyond the cap are still
+// counted so the log makes the truncation visible. One transport instance
+// is shared across all of skicka's (concurrent) Drive calls, so writes to
+// sink are serialized to keep interleaved request/response logs readable.
+func NewStreamingLoggingTransport(transport http.RoundTripper, sink io.Writer,
+	maxLogged int64) StreamingLoggingTransport {
+	return StreamingLoggingTransport{transport: transport, sink: &syncWriter{w: sink}, maxLogged: maxLogged}
+}
+
+// syncWriter serializes writes to an underlying io.Writer with a mutex, the
+// same way log.Logger does internally, so concurrent writers don't
+// interleave their output mid-line.
+type syncWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (sw *syncWriter) Write(p []byte) (int, error) {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	return sw.w.Write(p)
+}
+
+func (slt StreamingLoggingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	fmt.Fprintf(slt.sink, "[request] %s\n", sanitize(fmt.Sprintf("%s %s", req.Method, req.URL)))
+	for k, v := range req.Header {
+		fmt.Fprintf(slt.sink, "%s\n", sanitize(fmt.Sprintf("%s: %s", k, v)))
+	}
+	fmt.Fprintf(slt.sink, "\n")
+
+	if req.Body != nil {
+		req.Body = &loggingReadCloser{
+			ReadCloser: req.Body,
+			sink:       slt.sink,
+			remaining:  slt.maxLogged,
+			endMarker:  "[/request]",
+		}
+	} else {
+		fmt.Fprintf(slt.sink, "[/request]\n")
+	}
+
+	resp, err := slt.transport.RoundTrip(req)
+	if resp == nil {
+		fmt.Fprintf(slt.sink, "[response] <none> err: %v\n[/response]\n", err)
+		return resp, err
+	}
+
+	fmt.Fprintf(slt.sink, "[response] %s\n", resp.Status)
+	resp.Body = &loggingReadCloser{
+		ReadCloser: resp.Body,
+		sink:       slt.sink,
+		remaining:  slt.maxLogged,
+		endMarker:  "[/response]",
+	}
+	return resp, err
+}
+
+// loggingReadCloser tees the bytes read through it to a log sink, up to a
+// maximum number of bytes, and writes an end-of-stream marker to the sink
+// the first time it sees EOF. Bytes read after the cap is reached are
+// counted but not copied to the sink, so large transfers can be logged
+// without holding the whole body in memory.
+type loggingReadCloser struct {
+	io.ReadCloser
+	sink      io.Writer
+	remaining int64 // bytes still eligible to be logged; <0 means unlimited
+	dropped   int64
+	endMarker string
+	didEnd    bool
+}
+
+func (lrc *loggingReadCloser) Read(p []byte) (int, error) {
+	n, err := lrc.ReadCloser.Read(p)
+	if n > 0 {
+		chunk := p[:n]
+		if lrc.remaining < 0 {
+			lrc.sink.Write(chunk)
+		} else if lrc.remaining > 0 {
+			logged := chunk
+			if int64(len(logged)) > lrc.remaining {
+				logged = logged[:lrc.remaining]
+			}
+			lrc.sink.Write(logged)
+			lrc.remaining -= int64(len(logged))
+			lrc.dropped += int64(len(chunk) - len(logged))
+		} else {
+			lrc.dropped += int64(len(chunk))
+		}
+	}
+	if err == io.EOF && !lrc.didEnd {
+		lrc.didEnd = true
+		if lrc.dropped > 0 {
+			fmt.Fprintf(lrc.sink, "\n<%d bytes omitted>", lrc.dropped)
+		}
+		fmt.Fprintf(lrc.sink, "\n%s\n", lrc.endMarker)
+	}
+	return n, err
+}
+
+const (
+	retryBaseDelay    = 1 * time.Second
+	retryMaxDelay     = 64 * time.Second
+	retryDefaultTries = 7
+
+	// retryAttemptHeader is set on req before an attempt past the first,
+	// so that a transport further down the chain (metricsTransport) can
+	// tell a retry apart from a fresh request.
+	retryAttemptHeader = "X-Skicka-Retry-Attempt"
+)
+
+// retryTransport wraps another RoundTripper and retries requests that fail
+// with a transient error: HTTP 429/500/502/503/504, an io.ErrUnexpectedEOF
+// error returned by the wrapped transport, a TLS handshake failure, or a
+// Drive JSON error body whose reason is rateLimitExceeded,
+// userRateLimitExceeded, or backendError. A response body that is cut
+// short while the caller reads it, after RoundTrip has returned, is not
+// retried. Retries use exponential backoff with full jitter, honoring
+// a Retry-After header when the server sends one. A request with a body
+// must be re-sent on each attempt, so req.GetBody must be set for those
+// (as net/http does for requests built with http.NewRequest); RoundTrip
+// fails fast if it's nil and the body has already been consumed. Bodyless
+// requests (GETs, which cover files.get/files.list/changes.list and
+// downloads) need no rewinding and are always retried.
+type retryTransport struct {
+	transport  http.RoundTripper
+	maxRetries int
+
+	mu  sync.Mutex
+	rng *rand.Rand
+}
+
+func NewRetryTransport(transport http.RoundTripper) *retryTransport {
+	return &retryTransport{
+		transport:  transport,
+		maxRetries: retryDefaultTries,
+		rng:        rand.New(rand.NewSource(time.Now().UTC().UnixNano())),
+	}
+}
+
+func (rt *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var resp *http.Response
+	var err error
+
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 {
+			req.Header.Set(retryAttemptHeader, strconv.Itoa(attempt))
+		}
+		resp, err = rt.transport.RoundTrip(req)
+
+		retry, reason := isRetryable(resp, err)
+		if !retry || attempt >= rt.maxRetries {
+			return resp, err
+		}
+
+		if req.Body != nil {
+			if req.GetBody == nil {
+				return resp, err
+			}
+			body, berr := req.GetBody()
+			if berr != nil {
+				return resp, err
+			}
+			req.Body = body
+		}
+
+		delay := rt.delay(resp, attempt)
+		debug.Printf("retryTransport: attempt %d, %s, retrying in %s", attempt, reason, delay)
+
+		if resp != nil {
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+
+		time.Sleep(delay)
+	}
+}
+
+// isRetryable reports whether resp/err represents a transient failure
+// worth retrying, along with a short human-readable reason for logging.
+func isRetryable(resp *http.Response, err error) (bool, string) {
+	if err != nil {
+		if err == io.ErrUnexpectedEOF || isTLSHandshakeError(err) {
+			return true, err.Error()
+		}
+		return false, ""
+	}
+
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusInternalServerError,
+		http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true, resp.Status
+	}
+
+	// Only sniff the body for a Drive-style JSON error on responses that
+	// look like an error in the first place; reading a 2xx body here
+	// would force every successful download into memory, which is
+	// exactly what StreamingLoggingTransport exists to avoid.
+	if resp.StatusCode < 400 || !isJSONResponse(resp) {
+		return false, ""
+	}
+
+	if reason := driveErrorReason(resp); reason != "" {
+		switch reason {
+		case "rateLimitExceeded", "userRateLimitExceeded", "backendError":
+			return true, reason
+		}
+	}
+
+	return false, ""
+}
+
+func isJSONResponse(resp *http.Response) bool {
+	ct := resp.Header.Get("Content-Type")
+	return strings.HasPrefix(ct, "application/json")
+}
+
+// isTLSHandshakeError reports whether err looks like a failed TLS
+// handshake; the net/http client wraps these as plain errors, so we match
+// on the message rather than a concrete type.
+func isTLSHandshakeError(err error) bool {
+	return err != nil && bytes.Contains([]byte(err.Error()), []byte("tls: handshake failure"))
+}
+
+// driveErrorReason reads (and restores) resp.Body, returning the reason
+// code of the first error in a Drive-style JSON error body, or "" if the
+// body isn't one.
+func driveErrorReason(resp *http.Response) string {
+	if resp.Body == nil {
+		return ""
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return ""
+	}
+
+	var e struct {
+		Error struct {
+			Errors []struct {
+				Reason string `json:"reason"`
+			} `json:"errors"`
+		} `json:"error"`
+	}
+	if json.Unmarshal(body, &e) != nil || len(e.Error.Errors) == 0 {
+		return ""
+	}
+	return e.Error.Errors[0].Reason
+}
+
+// delay computes the next retry delay via retryDelay, serializing access
+// to rt.rng: a *rand.Rand is not safe for concurrent use, and rt is meant
+// to be one shared instance wrapping all of skicka's concurrent Drive
+// calls.
+func (rt *retryTransport) delay(resp *http.Response, attempt int) time.Duration {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	return retryDelay(resp, attempt, rt.rng)
+}
+
+// retryDelay computes how long to sleep before the next attempt: it honors
+// a Retry-After header (seconds or HTTP-date) if present, adding a small
+// jitter, and otherwise uses exponential backoff with full jitter,
+// drawing uniformly from [0, min(cap, base*2^attempt)]. Callers sharing a
+// single rng across goroutines must synchronize access themselves (see
+// retryTransport.delay); math/rand.Rand is not safe for concurrent use.
+func retryDelay(resp *http.Response, attempt int, rng *rand.Rand) time.Duration {
+	if resp != nil {
+		if ra := resp.Header.Get("Retry-After"); ra != "" {
+			if secs, err := strconv.Atoi(ra); err == nil {
+				base := time.Duration(secs) * time.Second
+				return base + time.Duration(rng.Int63n(int64(time.Second)))
+			}
+			if t, err := http.ParseTime(ra); err == nil {
+				if d := time.Until(t); d > 0 {
+					return d + time.Duration(rng.Int63n(int64(time.Second)))
+				}
+			}
+		}
+	}
+
+	sleep := retryBaseDelay * time.Duration(1<<uint(attempt))
+	if sleep > retryMaxDelay || sleep <= 0 {
+		sleep = retryMaxDelay
+	}
+	return time.Duration(rng.Int63n(int64(sleep) + 1))
+}
+
+// quotaTransport wraps another RoundTripper and enforces a client-side
+// budget on requests/second and on in-flight requests, so that
+// many-small-files workloads don't trip Drive's per-user QPS and
+// concurrent-request quotas. The two limits come from the [quota] section
+// of the skicka config file (queries_per_second, max_concurrent); either
+// may be left at zero to disable that particular limit.
+//
+// NOTE: this snapshot of the tree doesn't include config.go, so wiring
+// queriesPerSecond/maxConcurrent in from the parsed config file is left
+// to the call site that constructs the Drive client; NewQuotaTransport
+// takes them as plain arguments.
+type quotaTransport struct {
+	transport http.RoundTripper
+	normal    rate.Limit
+	limiter   *rate.Limiter
+	sem       chan struct{}
+
+	mu         sync.Mutex
+	pausedTill time.Time
+}
+
+// NewQuotaTransport returns a quotaTransport that rate-limits RoundTrip
+// calls to queriesPerSecond requests/second (0 means unlimited) and
+// allows at most maxConcurrent of them in flight at once (0 means
+// unlimited).
+func NewQuotaTransport(transport http.RoundTripper, queriesPerSecond float64,
+	maxConcurrent int) *quotaTransport {
+	qt := &quotaTransport{transport: transport}
+	if queriesPerSecond > 0 {
+		qt.normal = rate.Limit(queriesPerSecond)
+		qt.limiter = rate.NewLimiter(qt.normal, 1)
+	}
+	if maxConcurrent > 0 {
+		qt.sem = make(chan struct{}, maxConcurrent)
+	}
+	return qt
+}
+
+func (qt *quotaTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if qt.limiter != nil {
+		if err := qt.limiter.Wait(req.Context()); err != nil {
+			return nil, err
+		}
+	}
+
+	if qt.sem != nil {
+		select {
+		case qt.sem <- struct{}{}:
+			defer func() { <-qt.sem }()
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+
+	resp, err := qt.transport.RoundTrip(req)
+
+	if resp != nil && resp.StatusCode == http.StatusTooManyRequests && qt.limiter != nil {
+		if ra := resp.Header.Get("Retry-After"); ra != "" {
+			if secs, aerr := strconv.Atoi(ra); aerr == nil {
+				qt.pauseUntil(time.Now().Add(time.Duration(secs) * time.Second))
+			}
+		}
+	}
+
+	return resp, err
+}
+
+// pauseUntil zeroes the limiter's rate until till, so concurrent
+// in-flight requests back off together rather than immediately retrying.
+// Concurrent 429s calling this only ever race to extend the same pause
+// and restore the same fixed qt.normal rate, so unlike reading the
+// limiter's current (possibly already-zeroed) rate via Limit(), a second
+// caller can never clobber the restore with a stale "paused" value.
+func (qt *quotaTransport) pauseUntil(till time.Time) {
+	qt.mu.Lock()
+	defer qt.mu.Unlock()
+
+	if till.Before(qt.pausedTill) {
+		return
+	}
+	qt.pausedTill = till
+	qt.limiter.SetLimit(0)
+
+	time.AfterFunc(time.Until(till), func() {
+		qt.mu.Lock()
+		defer qt.mu.Unlock()
+		if !time.Now().Before(qt.pausedTill) {
+			qt.limiter.SetLimit(qt.normal)
+		}
+	})
+}
+
+var (
+	metricsRequestsTotal   = expvar.NewMap("skicka_http_requests_total")
+	metricsRetriesTotal    = expvar.NewMap("skicka_http_retries_total")
+	metricsDurationSeconds = expvar.NewMap("skicka_http_request_duration_seconds_total")
+	metricsBytesSent       = expvar.NewMap("skicka_http_bytes_sent_total")
+	metricsBytesReceived   = expvar.NewMap("skicka_http_bytes_received_total")
+)
+
+// metricsTransport wraps another RoundTripper and records, per Drive API
+// method, request latency, bytes sent/received, a count of responses by
+// status class, and a count of retries. The counters are plain
+// expvar.Maps, so they show up at /debug/vars for free; StartMetricsServer
+// additionally serves them in Prometheus text exposition format at
+// /metrics when --metrics-addr is set.
+//
+// Latency is measured from the start of RoundTrip to the response body
+// being closed, not just to the headers coming back: for uploads and
+// downloads, which is what this metric exists to diagnose, almost all of
+// the wall-clock time is spent streaming the body, so stopping the clock
+// at the headers would make slow transfers look instant.
+type metricsTransport struct {
+	transport http.RoundTripper
+}
+
+func NewMetricsTransport(transport http.RoundTripper) metricsTransport {
+	return metricsTransport{transport: transport}
+}
+
+func (mt metricsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	method := driveAPIMethod(req)
+	start := time.Now()
+
+	if req.Header.Get(retryAttemptHeader) != "" {
+		metricsRetriesTotal.Add(method, 1)
+	}
+
+	sent := &countingReadCloser{}
+	if req.Body != nil {
+		sent.ReadCloser = req.Body
+		req.Body = sent
+	}
+
+	resp, err := mt.transport.RoundTrip(req)
+	metricsBytesSent.Add(method, sent.n)
+
+	if err != nil {
+		metricsDurationSeconds.AddFloat(method, time.Since(start).Seconds())
+		metricsRequestsTotal.Add(method+":error", 1)
+		return resp, err
+	}
+
+	metricsRequestsTotal.Add(fmt.Sprintf("%s:%dxx", method, resp.StatusCode/100), 1)
+	resp.Body = &metricsBodyCloser{ReadCloser: resp.Body, method: method, start: start}
+
+	return resp, err
+}
+
+// countingReadCloser counts the bytes read through it; a nil embedded
+// ReadCloser behaves as an already-exhausted reader.
+type countingReadCloser struct {
+	io.ReadCloser
+	n int64
+}
+
+func (c *countingReadCloser) Read(p []byte) (int, error) {
+	if c.ReadCloser == nil {
+		return 0, io.EOF
+	}
+	n, err := c.ReadCloser.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// metricsBodyCloser counts the bytes read through it, as countingReadCloser
+// does, and reports the final byte count and total request latency when the body is closed, since that's
+// the point at which the caller is actually done with the response.
+type metricsBodyCloser struct {
+	io.ReadCloser
+	method string
+	start  time.Time
+	n      int64
+}
+
+func (m *metricsBodyCloser) Read(p []byte) (int, error) {
+	n, err := m.ReadCloser.Read(p)
+	m.n += int64(n)
+	return n, err
+}
+
+func (m *metricsBodyCloser) Close() error {
+	metricsBytesReceived.Add(m.method, m.n)
+	metricsDurationSeconds.AddFloat(m.method, time.Since(m.start).Seconds())
+	return m.ReadCloser.Close()
+}
+
+// driveAPIMethod derives a short Drive API method label such as
+// "files.get" or "changes.list" from a request, for use as a metrics
+// label. It's a best-effort heuristic covering the handful of endpoints
+// skicka calls, not a general Drive API path parser.
+func driveAPIMethod(req *http.Request) string {
+	path := req.URL.Path
+
+	switch {
+	case strings.Contains(path, "/drive/v3/changes"):
+		return "changes.list"
+
+	case strings.Contains(path, "/upload/drive/v3/files"):
+		if req.Method == http.MethodPatch || req.Method == http.MethodPut {
+			return "files.update"
+		}
+		return "files.insert"
+
+	case strings.Contains(path, "/drive/v3/files"):
+		switch req.Method {
+		case http.MethodPost:
+			return "files.insert"
+		case http.MethodDelete:
+			return "files.delete"
+		case http.MethodPatch, http.MethodPut:
+			return "files.update"
+		case http.MethodGet:
+			if strings.HasSuffix(strings.TrimSuffix(path, "/"), "files") {
+				return "files.list"
+			}
+			return "files.get"
+		}
+	}
+
+	return "unknown"
+}
+
+// StartMetricsServer starts a blocking HTTP server on addr exposing the
+// skicka_http_* counters at /metrics in Prometheus text exposition format
+// (suitable for a Prometheus server to scrape directly), plus expvar's own
+// JSON dump of the same counters at /debug/vars. It's meant to be run in
+// its own goroutine by the --metrics-addr flag handler.
+func StartMetricsServer(addr string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", servePrometheusMetrics)
+	mux.Handle("/debug/vars", expvar.Handler())
+	return http.ListenAndServe(addr, mux)
+}
+
+func servePrometheusMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	writePrometheusMap(w, "skicka_http_requests_total", metricsRequestsTotal, "method", "status")
+	writePrometheusMap(w, "skicka_http_retries_total", metricsRetriesTotal, "method")
+	writePrometheusMap(w, "skicka_http_request_duration_seconds_total", metricsDurationSeconds, "method")
+	writePrometheusMap(w, "skicka_http_bytes_sent_total", metricsBytesSent, "method")
+	writePrometheusMap(w, "skicka_http_bytes_received_total", metricsBytesReceived, "method")
+}
+
+// writePrometheusMap renders an expvar.Map as Prometheus text exposition
+// lines, splitting each entry's ":"-joined key into the given label names
+// (metricsRequestsTotal keys look like "files.get:2xx", for example).
+func writePrometheusMap(w io.Writer, name string, m *expvar.Map, labelNames ...string) {
+	m.Do(func(kv expvar.KeyValue) {
+		values := strings.SplitN(kv.Key, ":", len(labelNames))
+		var labels strings.Builder
+		for i, ln := range labelNames {
+			if i > 0 {
+				labels.WriteByte(',')
+			}
+			val := ""
+			if i < len(values) {
+				val = values[i]
+			}
+			fmt.Fprintf(&labels, "%s=%q", ln, val)
+		}
+		fmt.Fprintf(w, "%s{%s} %s\n", name, labels.String(), kv.Value.String())
+	})
+}
+
 type flakyTransport struct {
 	transport http.RoundTripper
 	rng       *rand.Rand
 	endTime   time.Time
+
+	scenario []compiledScenarioStep
+	mu       sync.Mutex
+	counters []int
 }
 
-func NewFlakyTransport(transport http.RoundTripper) http.RoundTripper {
-	seed := time.Now().UTC().UnixNano()
+// FlakyOption configures a flakyTransport built by NewFlakyTransport.
+type FlakyOption func(*flakyConfig)
+
+type flakyConfig struct {
+	seed     int64
+	hasSeed  bool
+	scenario []ScenarioStep
+}
+
+// WithSeed makes a flakyTransport's failures reproducible: the same seed
+// always produces the same sequence of random outcomes, so a failure seen
+// in a log line (which includes the seed) can be replayed exactly.
+func WithSeed(seed int64) FlakyOption {
+	return func(c *flakyConfig) { c.seed = seed; c.hasSeed = true }
+}
+
+// WithScenario makes a flakyTransport follow a scripted sequence of
+// outcomes per matching request, instead of picking random failures. See
+// ScenarioStep and LoadScenario.
+func WithScenario(steps []ScenarioStep) FlakyOption {
+	return func(c *flakyConfig) { c.scenario = steps }
+}
+
+// ScenarioAction describes one scripted outcome for a request matching a
+// ScenarioStep.
+type ScenarioAction struct {
+	// OK passes the request through to the real transport unmodified;
+	// all other fields are ignored when this is set.
+	OK bool `json:"ok,omitempty"`
+
+	// Status and Headers describe a synthetic response. Status defaults
+	// to 200 if unset.
+	Status  int               `json:"status,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    string            `json:"body,omitempty"`
+
+	// TruncateBodyAfter, if positive, makes the response body reader
+	// return io.ErrUnexpectedEOF after this many bytes, simulating a
+	// truncated chunked response.
+	TruncateBodyAfter int64 `json:"truncate_body_after,omitempty"`
+
+	// ConnReset simulates a connection reset before any response
+	// headers are received: RoundTrip returns an error, not a response.
+	ConnReset bool `json:"conn_reset,omitempty"`
+
+	// DelayBetweenBytesMS, if positive, makes the response body reader
+	// sleep this many milliseconds between each byte it returns.
+	DelayBetweenBytesMS int64 `json:"delay_between_bytes_ms,omitempty"`
+}
+
+// ScenarioStep scripts the sequence of outcomes returned for requests
+// matching Match, which has the form "METHOD regexp", e.g.
+// "POST .*/upload/drive/v3/files". Actions are consumed in order, one per
+// matching request; once exhausted, the last action repeats.
+type ScenarioStep struct {
+	Match   string           `json:"match"`
+	Actions []ScenarioAction `json:"actions"`
+}
+
+type compiledScenarioStep struct {
+	method string
+	path   *regexp.Regexp
+	step   ScenarioStep
+}
+
+// LoadScenario reads a scenario file and returns the steps it describes,
+// for use with WithScenario. Only the JSON form is implemented; a YAML
+// scenario file can be supported later by decoding into the same
+// []ScenarioStep shape.
+func LoadScenario(path string) ([]ScenarioStep, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var steps []ScenarioStep
+	if err := json.Unmarshal(data, &steps); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return steps, nil
+}
+
+func compileScenario(steps []ScenarioStep) ([]compiledScenarioStep, error) {
+	compiled := make([]compiledScenarioStep, len(steps))
+	for i, s := range steps {
+		parts := strings.SplitN(s.Match, " ", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid scenario match %q: want \"METHOD regexp\"", s.Match)
+		}
+		re, err := regexp.Compile(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid scenario match %q: %v", s.Match, err)
+		}
+		compiled[i] = compiledScenarioStep{method: parts[0], path: re, step: s}
+	}
+	return compiled, nil
+}
+
+// NewFlakyTransport returns a transport that injects synthetic failures
+// for testing, either randomly (the default) or, with WithScenario, by
+// replaying a scripted sequence of outcomes per matching request. Pass
+// WithSeed to make the random failures reproducible from a logged seed.
+func NewFlakyTransport(transport http.RoundTripper, opts ...FlakyOption) http.RoundTripper {
+	var cfg flakyConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	seed := cfg.seed
+	if !cfg.hasSeed {
+		seed = time.Now().UTC().UnixNano()
+	}
 	log.Printf("Flaky rand seed %d", seed)
-	return flakyTransport{transport: transport, rng: rand.New(rand.NewSource(seed))}
+
+	ft := &flakyTransport{transport: transport, rng: rand.New(rand.NewSource(seed))}
+
+	if len(cfg.scenario) > 0 {
+		compiled, err := compileScenario(cfg.scenario)
+		if err != nil {
+			log.Printf("flakyTransport: ignoring invalid scenario: %v", err)
+		} else {
+			ft.scenario = compiled
+			ft.counters = make([]int, len(compiled))
+		}
+	}
+
+	return ft
 }
 
-func (ft flakyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
-	if time.Now().After(ft.endTime) {
-		if ft.rng.Float32() > .03 {
-			return ft.transport.RoundTrip(req)
+func (ft *flakyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if len(ft.scenario) > 0 {
+		if resp, err, matched := ft.scenarioRoundTrip(req); matched {
+			return resp, err
 		}
-		delta := time.Duration(ft.rng.Int31()%(90*1000)) * time.Millisecond
-		ft.endTime = time.Now().Add(delta)
-		debug.Printf("Flaky http for %s", delta.String())
+	}
+
+	pass, dropCode, sendErr := ft.roll()
+	if pass {
+		return ft.transport.RoundTrip(req)
 	}
 
 	reqstr := sanitize(fmt.Sprintf("%+v", req))
-	if (ft.rng.Int() % 2) == 0 {
-		codes := []int{401, 403, 404, 408, 500, 503}
-		c := codes[int(ft.rng.Int31())%len(codes)]
-		debug.Printf("Dropping http request %s -> %d", reqstr, c)
+	if !sendErr {
+		debug.Printf("Dropping http request %s -> %d", reqstr, dropCode)
 		return &http.Response{
 				Body:       ioutil.NopCloser(bytes.NewReader([]byte("flaky error body"))),
-				Status:     fmt.Sprintf("%d Flaky Error", c),
-				StatusCode: c,
+				Status:     fmt.Sprintf("%d Flaky Error", dropCode),
+				StatusCode: dropCode,
 				Request:    req},
 			nil
 	}
 	debug.Printf("Returning error from http request %s", reqstr)
 	return nil, fmt.Errorf("flaky http error")
 }
+
+// roll draws the outcome of the non-scenario, purely-random flakiness
+// mode: whether to pass the request through, and if not, whether to drop
+// it with a synthetic status code or return a bare error. ft.rng and
+// ft.endTime are shared mutable state read and written from every
+// concurrent RoundTrip call, so both the draw and any state update happen
+// under ft.mu — otherwise a fixed seed wouldn't reproduce a fixed outcome
+// sequence under concurrent load, defeating the point of WithSeed.
+func (ft *flakyTransport) roll() (pass bool, dropCode int, sendErr bool) {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+
+	if time.Now().After(ft.endTime) {
+		if ft.rng.Float32() > .03 {
+			return true, 0, false
+		}
+		delta := time.Duration(ft.rng.Int31()%(90*1000)) * time.Millisecond
+		ft.endTime = time.Now().Add(delta)
+		debug.Printf("Flaky http for %s", delta.String())
+	}
+
+	if (ft.rng.Int() % 2) == 0 {
+		codes := []int{401, 403, 404, 408, 500, 503}
+		return false, codes[int(ft.rng.Int31())%len(codes)], false
+	}
+	return false, 0, true
+}
+
+// scenarioRoundTrip checks req against the configured scenario. matched is
+// false if no step matches, in which case the caller should fall back to
+// the transport's normal random flakiness.
+func (ft *flakyTransport) scenarioRoundTrip(req *http.Request) (resp *http.Response, err error, matched bool) {
+	for i, cs := range ft.scenario {
+		if cs.method != "" && cs.method != req.Method {
+			continue
+		}
+		if !cs.path.MatchString(req.URL.Path) {
+			continue
+		}
+
+		ft.mu.Lock()
+		idx := ft.counters[i]
+		if idx < len(cs.step.Actions)-1 {
+			ft.counters[i]++
+		}
+		ft.mu.Unlock()
+
+		action := cs.step.Actions[idx]
+		debug.Printf("flakyTransport: scenario %q matched, action %d: %+v", cs.step.Match, idx, action)
+
+		if action.OK {
+			resp, err := ft.transport.RoundTrip(req)
+			return resp, err, true
+		}
+		resp, err := scenarioResponse(req, action)
+		return resp, err, true
+	}
+	return nil, nil, false
+}
+
+// scenarioResponse builds the synthetic response or error described by a
+// single ScenarioAction.
+func scenarioResponse(req *http.Request, action ScenarioAction) (*http.Response, error) {
+	if action.ConnReset {
+		return nil, fmt.Errorf("read tcp: connection reset by peer")
+	}
+
+	status := action.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	var body io.ReadCloser
+	switch {
+	case action.TruncateBodyAfter > 0:
+		// The action only promises to truncate after N bytes, not what
+		// those bytes are, so synthesize filler instead of depending on
+		// Body containing (or being padded to) that many bytes.
+		body = &truncatingReader{r: fillerReader(action, action.TruncateBodyAfter), limit: action.TruncateBodyAfter}
+	case action.DelayBetweenBytesMS > 0:
+		body = &delayedReader{
+			r:     fillerReader(action, action.contentLength()),
+			delay: time.Duration(action.DelayBetweenBytesMS) * time.Millisecond,
+		}
+	default:
+		body = ioutil.NopCloser(strings.NewReader(action.Body))
+	}
+
+	resp := &http.Response{
+		Status:     fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode: status,
+		Header:     make(http.Header),
+		Body:       body,
+		Request:    req,
+	}
+	for k, v := range action.Headers {
+		resp.Header.Set(k, v)
+	}
+	return resp, nil
+}
+
+// contentLength returns the byte count implied by a Content-Length header
+// set on the action, or 0 if there isn't one or it doesn't parse.
+func (a ScenarioAction) contentLength() int64 {
+	if a.Headers == nil {
+		return 0
+	}
+	n, err := strconv.ParseInt(a.Headers["Content-Length"], 10, 64)
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+// fillerReader returns a reader producing n bytes: action.Body repeated
+// to fill n bytes if one was given, or else a fixed filler byte. This
+// lets TruncateBodyAfter/DelayBetweenBytesMS simulate any byte count
+// without the scenario author embedding a literal blob of that size in
+// the JSON file. n<=0 falls back to returning action.Body verbatim.
+func fillerReader(action ScenarioAction, n int64) io.Reader {
+	if n <= 0 {
+		return strings.NewReader(action.Body)
+	}
+	if action.Body != "" {
+		return io.LimitReader(&repeatStringReader{s: action.Body}, n)
+	}
+	return io.LimitReader(repeatByteReader('x'), n)
+}
+
+// repeatStringReader repeats s indefinitely; pair with io.LimitReader to
+// bound it.
+type repeatStringReader struct {
+	s   string
+	pos int
+}
+
+func (r *repeatStringReader) Read(p []byte) (int, error) {
+	if len(r.s) == 0 {
+		return 0, io.EOF
+	}
+	for n := range p {
+		p[n] = r.s[r.pos]
+		r.pos = (r.pos + 1) % len(r.s)
+	}
+	return len(p), nil
+}
+
+// repeatByteReader fills every Read with the same byte indefinitely; pair
+// with io.LimitReader to bound it.
+type repeatByteReader byte
+
+func (r repeatByteReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = byte(r)
+	}
+	return len(p), nil
+}
+
+// truncatingReader returns io.ErrUnexpectedEOF after limit bytes,
+// simulating a connection that drops mid-response.
+type truncatingReader struct {
+	r     io.Reader
+	limit int64
+	read  int64
+}
+
+func (t *truncatingReader) Read(p []byte) (int, error) {
+	if t.read >= t.limit {
+		return 0, io.ErrUnexpectedEOF
+	}
+	if remaining := t.limit - t.read; int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+	n, err := t.r.Read(p)
+	t.read += int64(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (t *truncatingReader) Close() error { return nil }
+
+// delayedReader returns one byte at a time, sleeping delay before each,
+// simulating a slow/stalled stream.
+type delayedReader struct {
+	r     io.Reader
+	delay time.Duration
+}
+
+func (d *delayedReader) Read(p []byte) (int, error) {
+	time.Sleep(d.delay)
+	if len(p) > 1 {
+		p = p[:1]
+	}
+	return d.r.Read(p)
+}
+
+func (d *delayedReader) Close() error { return nil }
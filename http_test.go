@@ -0,0 +1,433 @@
+//
+// http_test.go
+// Copyright(c)2014-2015 Google, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mapValue reads the current numeric value of an expvar.Map entry,
+// treating a missing key as 0.
+func mapValue(m *expvar.Map, key string) float64 {
+	switch v := m.Get(key).(type) {
+	case *expvar.Int:
+		return float64(v.Value())
+	case *expvar.Float:
+		return v.Value()
+	default:
+		return 0
+	}
+}
+
+func jsonErrorBody(reason string) io.ReadCloser {
+	body := fmt.Sprintf(`{"error":{"errors":[{"reason":%q}]}}`, reason)
+	return ioutil.NopCloser(strings.NewReader(body))
+}
+
+// TestStreamingLoggingTransportCapsLoggedBody checks that a response body
+// larger than maxLogged is still delivered to the caller in full, while
+// only maxLogged bytes of it are copied to the log sink, with the
+// remainder reported as omitted rather than silently dropped.
+func TestStreamingLoggingTransportCapsLoggedBody(t *testing.T) {
+	const bodyLen = 100
+	const maxLogged = 10
+	body := strings.Repeat("x", bodyLen)
+
+	underlying := fakeRoundTripper{resp: &http.Response{
+		StatusCode: 200,
+		Status:     "200 OK",
+		Body:       ioutil.NopCloser(strings.NewReader(body)),
+	}}
+
+	var sink bytes.Buffer
+	transport := NewStreamingLoggingTransport(underlying, &sink, maxLogged)
+
+	req := httptest.NewRequest("GET", "http://example.com/drive/v3/files/abc", nil)
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("RoundTrip: %v", err)
+	}
+
+	got, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("reading response body: %v", err)
+	}
+	if string(got) != body {
+		t.Fatalf("streaming logging transport altered the body: got %d bytes, want %d", len(got), bodyLen)
+	}
+
+	logged := sink.String()
+	if !strings.Contains(logged, strings.Repeat("x", maxLogged)) {
+		t.Fatalf("log is missing the %d-byte capped chunk: %q", maxLogged, logged)
+	}
+	if strings.Contains(logged, strings.Repeat("x", maxLogged+1)) {
+		t.Fatalf("log exceeded the %d-byte cap: %q", maxLogged, logged)
+	}
+	if !strings.Contains(logged, fmt.Sprintf("%d bytes omitted", bodyLen-maxLogged)) {
+		t.Fatalf("log doesn't report the %d omitted bytes: %q", bodyLen-maxLogged, logged)
+	}
+	if !strings.Contains(logged, "[response]") || !strings.Contains(logged, "[/response]") {
+		t.Fatalf("log missing response framing markers: %q", logged)
+	}
+}
+
+// TestStreamingLoggingTransportUnlimited checks that a negative maxLogged
+// disables the cap entirely.
+func TestStreamingLoggingTransportUnlimited(t *testing.T) {
+	body := strings.Repeat("y", 1000)
+	underlying := fakeRoundTripper{resp: &http.Response{
+		StatusCode: 200,
+		Status:     "200 OK",
+		Body:       ioutil.NopCloser(strings.NewReader(body)),
+	}}
+
+	var sink bytes.Buffer
+	transport := NewStreamingLoggingTransport(underlying, &sink, -1)
+
+	req := httptest.NewRequest("GET", "http://example.com/drive/v3/files/abc", nil)
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("RoundTrip: %v", err)
+	}
+	if _, err := ioutil.ReadAll(resp.Body); err != nil {
+		t.Fatalf("reading response body: %v", err)
+	}
+
+	if !strings.Contains(sink.String(), body) {
+		t.Fatalf("unlimited maxLogged should log the whole body, got %q", sink.String())
+	}
+	if strings.Contains(sink.String(), "bytes omitted") {
+		t.Fatalf("unlimited maxLogged shouldn't report any omitted bytes: %q", sink.String())
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		name      string
+		resp      *http.Response
+		err       error
+		wantRetry bool
+	}{
+		{
+			name:      "200 OK",
+			resp:      &http.Response{StatusCode: 200, Header: http.Header{}, Body: http.NoBody},
+			wantRetry: false,
+		},
+		{
+			name:      "429 Too Many Requests",
+			resp:      &http.Response{StatusCode: 429, Header: http.Header{}, Body: http.NoBody},
+			wantRetry: true,
+		},
+		{
+			name:      "503 Service Unavailable",
+			resp:      &http.Response{StatusCode: 503, Header: http.Header{}, Body: http.NoBody},
+			wantRetry: true,
+		},
+		{
+			name:      "404 Not Found",
+			resp:      &http.Response{StatusCode: 404, Header: http.Header{}, Body: http.NoBody},
+			wantRetry: false,
+		},
+		{
+			name:      "io.ErrUnexpectedEOF",
+			err:       io.ErrUnexpectedEOF,
+			wantRetry: true,
+		},
+		{
+			name:      "unrelated error",
+			err:       fmt.Errorf("boom"),
+			wantRetry: false,
+		},
+		{
+			name: "Drive rateLimitExceeded JSON body",
+			resp: &http.Response{
+				StatusCode: 403,
+				Header:     http.Header{"Content-Type": []string{"application/json"}},
+				Body:       jsonErrorBody("rateLimitExceeded"),
+			},
+			wantRetry: true,
+		},
+		{
+			name: "Drive notFound JSON body is not retryable",
+			resp: &http.Response{
+				StatusCode: 403,
+				Header:     http.Header{"Content-Type": []string{"application/json"}},
+				Body:       jsonErrorBody("notFound"),
+			},
+			wantRetry: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if retry, _ := isRetryable(tt.resp, tt.err); retry != tt.wantRetry {
+				t.Errorf("isRetryable() = %v, want %v", retry, tt.wantRetry)
+			}
+		})
+	}
+}
+
+// TestIsRetryableDoesNotBufferSuccessBody guards against reintroducing the
+// chunk0-1 OOM problem: a 2xx response body must never be read into
+// memory just to sniff for a Drive JSON error.
+func TestIsRetryableDoesNotBufferSuccessBody(t *testing.T) {
+	body := []byte(`{"error":{"errors":[{"reason":"rateLimitExceeded"}]}}`)
+	resp := &http.Response{
+		StatusCode: 200,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       ioutil.NopCloser(bytes.NewReader(body)),
+	}
+
+	if retry, _ := isRetryable(resp, nil); retry {
+		t.Fatalf("isRetryable() = true for a 200 response, want false")
+	}
+
+	got, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("resp.Body unreadable after isRetryable: %v", err)
+	}
+	if !bytes.Equal(got, body) {
+		t.Fatalf("isRetryable() consumed resp.Body: got %q, want %q", got, body)
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+
+	t.Run("Retry-After seconds", func(t *testing.T) {
+		resp := &http.Response{Header: http.Header{"Retry-After": []string{"5"}}}
+		d := retryDelay(resp, 0, rng)
+		if d < 5*time.Second || d > 6*time.Second {
+			t.Errorf("retryDelay() = %s, want within [5s, 6s]", d)
+		}
+	})
+
+	t.Run("exponential backoff stays within base*2^attempt", func(t *testing.T) {
+		for i := 0; i < 50; i++ {
+			d := retryDelay(nil, 2, rng)
+			if d > 4*time.Second {
+				t.Fatalf("retryDelay() = %s, want <= 4s", d)
+			}
+		}
+	})
+
+	t.Run("exponential backoff is capped", func(t *testing.T) {
+		for i := 0; i < 50; i++ {
+			d := retryDelay(nil, 20, rng)
+			if d > retryMaxDelay {
+				t.Fatalf("retryDelay() = %s, want <= cap %s", d, retryMaxDelay)
+			}
+		}
+	})
+}
+
+type fakeRoundTripper struct {
+	resp *http.Response
+	err  error
+}
+
+func (f fakeRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f.resp, f.err
+}
+
+// TestRetryTransportDelayConcurrent guards against a data race on the
+// shared *rand.Rand: a retryTransport is meant to be one instance wrapping
+// all of skicka's concurrent Drive calls, so concurrent retries must not
+// call rt.delay (and therefore rng.Int63n) unsynchronized. Run with
+// -race.
+func TestRetryTransportDelayConcurrent(t *testing.T) {
+	rt := NewRetryTransport(fakeRoundTripper{})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(attempt int) {
+			defer wg.Done()
+			rt.delay(nil, attempt%5)
+		}(i)
+	}
+	wg.Wait()
+}
+
+// TestQuotaTransportPauseConcurrent429 guards against the limiter getting
+// stuck at rate 0 forever when multiple in-flight requests hit 429 around
+// the same time: every pauseUntil call races to extend the same
+// pausedTill deadline and restore the same fixed qt.normal rate, so no
+// goroutine can clobber the restore with a stale value.
+func TestQuotaTransportPauseConcurrent429(t *testing.T) {
+	qt := NewQuotaTransport(fakeRoundTripper{}, 10, 0)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			qt.pauseUntil(time.Now().Add(50 * time.Millisecond))
+		}()
+	}
+	wg.Wait()
+
+	time.Sleep(200 * time.Millisecond)
+
+	if got := qt.limiter.Limit(); got != qt.normal {
+		t.Fatalf("limiter stuck at %v after the pause window elapsed, want restored to %v", got, qt.normal)
+	}
+}
+
+// TestFlakyTransportScenario replays a resumable-upload scenario: a 308
+// Resume Incomplete probe, then a truncated body, then success, and
+// checks that exhausted scenarios repeat their last action rather than
+// falling back to random flakiness.
+func TestFlakyTransportScenario(t *testing.T) {
+	okResp := &http.Response{StatusCode: 200, Body: ioutil.NopCloser(strings.NewReader("ok"))}
+	underlying := fakeRoundTripper{resp: okResp}
+
+	scenario := []ScenarioStep{
+		{
+			Match: "POST .*/upload/drive/v3/files",
+			Actions: []ScenarioAction{
+				{Status: 308, Headers: map[string]string{"Range": "bytes=0-524287"}},
+				{TruncateBodyAfter: 1024},
+				{OK: true},
+			},
+		},
+	}
+
+	transport := NewFlakyTransport(underlying, WithSeed(1), WithScenario(scenario))
+	req := httptest.NewRequest("POST", "http://example.com/upload/drive/v3/files", nil)
+
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("first request: unexpected error %v", err)
+	}
+	if resp.StatusCode != 308 || resp.Header.Get("Range") != "bytes=0-524287" {
+		t.Fatalf("first request: got %+v, want 308 with a Range header", resp)
+	}
+
+	resp, err = transport.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("second request: unexpected error %v", err)
+	}
+	body, readErr := ioutil.ReadAll(resp.Body)
+	if !errors.Is(readErr, io.ErrUnexpectedEOF) {
+		t.Fatalf("second request body error = %v, want io.ErrUnexpectedEOF", readErr)
+	}
+	if len(body) != 1024 {
+		t.Fatalf("second request body length = %d, want 1024", len(body))
+	}
+
+	resp, err = transport.RoundTrip(req)
+	if err != nil || resp != okResp {
+		t.Fatalf("third request = (%+v, %v), want the underlying transport's response", resp, err)
+	}
+
+	resp, err = transport.RoundTrip(req)
+	if err != nil || resp != okResp {
+		t.Fatalf("scenario should repeat its last action once exhausted, got (%+v, %v)", resp, err)
+	}
+}
+
+// TestMetricsTransportRecordsBytesAndDuration checks that metricsTransport
+// attributes received bytes and latency to the response body being
+// closed, not to RoundTrip returning headers: stopping the clock early
+// would make slow uploads/downloads (the whole point of this metric)
+// read as near-instant.
+func TestMetricsTransportRecordsBytesAndDuration(t *testing.T) {
+	const method = "files.get"
+	beforeBytes := mapValue(metricsBytesReceived, method)
+	beforeDur := mapValue(metricsDurationSeconds, method)
+	beforeReqs := mapValue(metricsRequestsTotal, method+":2xx")
+
+	const respBody = "0123456789"
+	underlying := fakeRoundTripper{resp: &http.Response{
+		StatusCode: 200,
+		Body:       ioutil.NopCloser(strings.NewReader(respBody)),
+	}}
+	transport := NewMetricsTransport(underlying)
+
+	req := httptest.NewRequest("GET", "http://example.com/drive/v3/files/abc123", nil)
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("RoundTrip: %v", err)
+	}
+
+	if got := mapValue(metricsDurationSeconds, method); got != beforeDur {
+		t.Fatalf("duration recorded before body close: before=%v, after=%v", beforeDur, got)
+	}
+
+	time.Sleep(5 * time.Millisecond)
+	if _, err := ioutil.ReadAll(resp.Body); err != nil {
+		t.Fatalf("reading response body: %v", err)
+	}
+	if err := resp.Body.Close(); err != nil {
+		t.Fatalf("closing response body: %v", err)
+	}
+
+	if got, want := mapValue(metricsBytesReceived, method), beforeBytes+float64(len(respBody)); got != want {
+		t.Fatalf("bytes received = %v, want %v", got, want)
+	}
+	if got := mapValue(metricsDurationSeconds, method); got <= beforeDur {
+		t.Fatalf("duration not recorded after body close: before=%v, after=%v", beforeDur, got)
+	}
+	if got, want := mapValue(metricsRequestsTotal, method+":2xx"), beforeReqs+1; got != want {
+		t.Fatalf("requests total = %v, want %v", got, want)
+	}
+}
+
+// TestWritePrometheusMap checks the Prometheus text exposition format,
+// including splitting a ":"-joined expvar.Map key (as produced for
+// metricsRequestsTotal, e.g. "files.get:2xx") back into separate labels.
+func TestWritePrometheusMap(t *testing.T) {
+	t.Run("two labels from a colon-joined key", func(t *testing.T) {
+		m := expvar.NewMap("test_two_label_map")
+		m.Add("files.get:2xx", 3)
+
+		var buf bytes.Buffer
+		writePrometheusMap(&buf, "test_requests_total", m, "method", "status")
+
+		want := `test_requests_total{method="files.get",status="2xx"} 3` + "\n"
+		if got := buf.String(); got != want {
+			t.Fatalf("writePrometheusMap() = %q, want %q", got, want)
+		}
+	})
+
+	t.Run("single label, no colon in key", func(t *testing.T) {
+		m := expvar.NewMap("test_single_label_map")
+		m.Add("files.list", 42)
+
+		var buf bytes.Buffer
+		writePrometheusMap(&buf, "test_bytes_total", m, "method")
+
+		want := `test_bytes_total{method="files.list"} 42` + "\n"
+		if got := buf.String(); got != want {
+			t.Fatalf("writePrometheusMap() = %q, want %q", got, want)
+		}
+	})
+}